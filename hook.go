@@ -2,13 +2,17 @@ package serverhook
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -17,23 +21,83 @@ import (
 // BufSize is used as the channel size which buffers log entries before sending them asynchrously to the log server.
 // Set serverhook.BufSize = <value> _before_ calling NewServerHook
 // Once the buffer is full, logging will start blocking, waiting for slots to be available in the queue.
+//
+// Deprecated: use the WithBufferSize option to set the buffer size of a single hook.
 var BufSize uint = 8192
 
+// defaultTimeout is the timeout of the default HTTP client.
+const defaultTimeout = 10 * time.Second
+
+// defaultBatchInterval is the interval used for batches, if no interval is set.
+// Otherwise, entries on a quiet service might never be sent.
+const defaultBatchInterval = 5 * time.Second
+
+// defaultDrainTimeout is the default time to send the remaining entries when the context of the hook is cancelled.
+const defaultDrainTimeout = 10 * time.Second
+
+// defaultErrorInterval is the default minimum interval between two printed send errors.
+const defaultErrorInterval = 10 * time.Minute
+
+// maxBackoff is the upper limit for the delay between two retries.
+const maxBackoff = time.Minute
+
+// maxRetryAfter is the upper limit for the delay requested by a Retry-After header.
+const maxRetryAfter = 5 * time.Minute
+
 // ServerHook to send logs to logcollect server.
 type ServerHook struct {
+	// Counters are accessed atomically, so they are kept at the start of the struct to be 64-bit aligned.
+	sent     uint64
+	failed   uint64
+	buffered uint64
+
 	typ string
 	url string
 
 	secret         string
 	keepColors     bool
 	suppressErrors bool
+	includeMeta    bool
+	typedFields    bool
+
+	host string
+	pid  int
+
+	client  *http.Client
+	timeout time.Duration
+	headers map[string]string
+
+	synchronous   bool
+	bufSize       uint
+	batch         bool
+	batchSize     int
+	batchInterval time.Duration
+	retries       int
+	retryBackoff  time.Duration
+	drainTimeout  time.Duration
+
+	buf      chan *logrus.Entry
+	flushReq chan struct{}
+	done     chan struct{}
+	closed   bool
+	wg       sync.WaitGroup
+	mu       sync.RWMutex
+
+	// reqCtx is cancelled when the hook is stopped to abort running requests.
+	reqCtx    context.Context
+	cancelReq context.CancelFunc
+
+	onError       func(error)
+	errorInterval time.Duration
+	errMu         sync.Mutex // guards nextError
+	nextError     time.Time
+}
 
-	synchronous bool
-	buf         chan *logrus.Entry
-	wg          sync.WaitGroup
-	mu          sync.RWMutex
-
-	nextError time.Time
+// Stats contains the delivery statistics of a hook.
+type Stats struct {
+	Sent     uint64 // number of entries sent to the server
+	Failed   uint64 // number of entries that could not be sent or were dropped
+	Buffered uint64 // number of entries waiting to be sent
 }
 
 // Test if the ServerHook matches the logrus.Hook interface.
@@ -41,6 +105,13 @@ var _ logrus.Hook = (*ServerHook)(nil)
 
 // NewServerHook creates a hook to be added to an instance of logger.
 func NewServerHook(typ, url string, options ...Option) (*ServerHook, error) {
+	return NewServerHookContext(context.Background(), typ, url, options...)
+}
+
+// NewServerHookContext creates a hook to be added to an instance of logger, which is closed when the context is cancelled.
+// On cancellation, the remaining buffered entries are sent until the drain timeout elapses (10 seconds by default).
+// Then running requests are aborted and entries that could not be sent are dropped.
+func NewServerHookContext(ctx context.Context, typ, url string, options ...Option) (*ServerHook, error) {
 	if typ == "" {
 		return nil, errors.New("empty log type")
 	}
@@ -49,30 +120,98 @@ func NewServerHook(typ, url string, options ...Option) (*ServerHook, error) {
 	}
 
 	h := &ServerHook{
-		typ: typ,
-		url: url,
+		typ:           typ,
+		url:           url,
+		bufSize:       BufSize,
+		drainTimeout:  defaultDrainTimeout,
+		errorInterval: defaultErrorInterval,
 	}
 
 	for _, o := range options {
 		o.apply(h)
 	}
 
+	if h.client == nil {
+		h.client = &http.Client{Timeout: defaultTimeout}
+	}
+
+	if h.batch && h.batchInterval <= 0 {
+		h.batchInterval = defaultBatchInterval
+	}
+
+	if h.timeout > 0 {
+		// Copy the client to not modify a client passed by the caller.
+		c := *h.client
+		c.Timeout = h.timeout
+		h.client = &c
+	}
+
+	if h.includeMeta {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+
+		h.host = host
+		h.pid = os.Getpid()
+	}
+
+	h.done = make(chan struct{})
+	h.reqCtx, h.cancelReq = context.WithCancel(context.Background())
+
 	if !h.synchronous {
-		h.buf = make(chan *logrus.Entry, BufSize)
+		h.buf = make(chan *logrus.Entry, h.bufSize)
+
+		if h.batch {
+			h.flushReq = make(chan struct{})
+
+			go h.batchWorker()
+		} else {
+			go h.worker()
+		}
+	}
 
-		go h.worker()
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				h.close(h.drainTimeout)
+			case <-h.done:
+			}
+		}()
 	}
 
 	return h, nil
 }
 
+// sendErrorKey marks the context of send errors logged by the hook itself.
+type sendErrorKey struct{}
+
 // Fire sends a log entry to the server.
+// Panic and fatal entries are sent immediately with a single attempt, ahead of the queued entries.
+// Because logrus exits after a fatal entry, entries still queued at that point are not delivered.
 func (h *ServerHook) Fire(entry *logrus.Entry) error {
+	// Send errors of the hook are not sent to the server, that just failed.
+	// This also prevents a deadlock if the error is logged while Flush holds the lock.
+	if entry.Context != nil && entry.Context.Value(sendErrorKey{}) != nil {
+		return nil
+	}
+
 	h.mu.RLock() // Claim the mutex as a RLock - allowing multiple go routines to log simultaneously
 	defer h.mu.RUnlock()
 
+	if h.closed {
+		return errors.New("hook is closed")
+	}
+
+	// Panic and fatal entries are sent immediately, because the process is likely to terminate.
+	// Waiting for the whole queue or retrying may take too long.
+	if entry.Level == logrus.PanicLevel || entry.Level == logrus.FatalLevel {
+		return h.report(h.sendEntry(entry, sendOnce))
+	}
+
 	if h.synchronous {
-		return h.sendEntry(entry)
+		return h.report(h.sendEntry(entry, sendCaller))
 	}
 
 	// Creating a new entry to prevent data races
@@ -91,12 +230,9 @@ func (h *ServerHook) Fire(entry *logrus.Entry) error {
 	}
 
 	h.wg.Add(1)
+	atomic.AddUint64(&h.buffered, 1)
 	h.buf <- newEntry
 
-	if entry.Level == logrus.PanicLevel || entry.Level == logrus.FatalLevel {
-		h.wg.Wait()
-	}
-
 	return nil
 }
 
@@ -106,9 +242,105 @@ func (h *ServerHook) Flush() {
 	h.mu.Lock() // claim the mutex as a Lock - we want exclusive access to it
 	defer h.mu.Unlock()
 
+	if !h.closed {
+		h.wait()
+	}
+}
+
+// Close waits for the log queue to be empty and stops the background worker.
+// Entries fired after the hook was closed are rejected with an error.
+func (h *ServerHook) Close() {
+	h.close(0)
+}
+
+// close stops the hook. If the timeout is > 0, the remaining entries are dropped once it elapsed.
+func (h *ServerHook) close(timeout time.Duration) {
+	h.mu.Lock()
+
+	if h.closed {
+		h.mu.Unlock()
+		return
+	}
+
+	// After closed is set, no entries are added to the queue anymore.
+	// The queue is drained without holding the lock, so logging in other go routines is not blocked
+	// and send errors, which are logged with logrus, cannot deadlock in Fire.
+	h.closed = true
+	h.mu.Unlock()
+
+	if h.synchronous {
+		h.stop()
+		return
+	}
+
+	if timeout <= 0 {
+		h.wait()
+		h.stop()
+		return
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		h.wait()
+		close(drained)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-drained:
+	case <-timer.C:
+	}
+
+	h.stop() // the worker drops all entries, that were not sent yet
+}
+
+// stop stops the background worker and aborts running requests.
+func (h *ServerHook) stop() {
+	close(h.done)
+	h.cancelReq()
+}
+
+// wait waits for the log queue to be empty. A pending batch is sent immediately.
+func (h *ServerHook) wait() {
+	if h.flushReq != nil {
+		select {
+		case h.flushReq <- struct{}{}:
+		case <-h.done:
+		}
+	}
+
 	h.wg.Wait()
 }
 
+// drop removes all entries from the log queue without sending them.
+func (h *ServerHook) drop() {
+	for len(h.buf) > 0 {
+		<-h.buf
+
+		atomic.AddUint64(&h.failed, 1)
+		h.processed(1)
+	}
+}
+
+// processed removes n entries, which were sent or dropped, from the log queue.
+func (h *ServerHook) processed(n int) {
+	if n > 0 {
+		atomic.AddUint64(&h.buffered, ^uint64(n-1))
+		h.wg.Add(-n)
+	}
+}
+
+// Stats returns the delivery statistics of the hook.
+func (h *ServerHook) Stats() Stats {
+	return Stats{
+		Sent:     atomic.LoadUint64(&h.sent),
+		Failed:   atomic.LoadUint64(&h.failed),
+		Buffered: atomic.LoadUint64(&h.buffered),
+	}
+}
+
 // Levels returns the Levels used for this hook.
 func (h *ServerHook) Levels() []logrus.Level {
 	return logrus.AllLevels
@@ -117,30 +349,143 @@ func (h *ServerHook) Levels() []logrus.Level {
 // process runs the worker queue in the background
 func (h *ServerHook) worker() {
 	for {
-		entry := <-h.buf // receive new entry on channel
+		// Check if the hook was stopped first, because select chooses randomly between ready cases.
+		select {
+		case <-h.done:
+			h.drop()
+			return
+		default:
+		}
+
+		select {
+		case entry := <-h.buf: // receive new entry on channel
+			err := h.sendEntry(entry, sendWorker)
+			if err != nil {
+				h.showError(err)
+			}
+
+			h.processed(1)
+		case <-h.done:
+			h.drop()
+			return
+		}
+	}
+}
+
+// batchWorker runs the worker queue in the background and sends the entries in batches.
+// A batch is sent once it is full or the batch interval elapsed.
+func (h *ServerHook) batchWorker() {
+	var batch []*serverLogEntry
 
-		err := h.sendEntry(entry)
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		err := h.sendBatch(batch, sendWorker)
 		if err != nil {
-			if !h.suppressErrors && h.nextError.Before(time.Now()) {
-				logrus.Error("Failed to send log to server: " + err.Error())
+			h.showError(err)
+		}
+
+		h.processed(len(batch))
+		batch = nil
+	}
 
-				h.nextError = time.Now().Add(10 * time.Minute)
+	add := func(entry *logrus.Entry) {
+		batch = append(batch, h.createServerEntry(entry))
+
+		if h.batchSize > 0 && len(batch) >= h.batchSize {
+			send()
+		}
+	}
+
+	var tick <-chan time.Time
+	if h.batchInterval > 0 {
+		ticker := time.NewTicker(h.batchInterval)
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	for {
+		// Check if the hook was stopped first, because select chooses randomly between ready cases.
+		select {
+		case <-h.done:
+			atomic.AddUint64(&h.failed, uint64(len(batch)))
+			h.processed(len(batch))
+			h.drop()
+			return
+		default:
+		}
+
+		select {
+		case entry := <-h.buf:
+			add(entry)
+		case <-tick:
+			send()
+		case <-h.flushReq:
+			// No entries are added during a flush, so the buffer can be drained completely.
+			for len(h.buf) > 0 {
+				add(<-h.buf)
 			}
+
+			send()
+		case <-h.done:
+			atomic.AddUint64(&h.failed, uint64(len(batch)))
+			h.processed(len(batch))
+			h.drop()
+			return
 		}
+	}
+}
+
+// showError prints an error, if sending log entries failed.
+// If an error handler is set, it is called instead.
+// The error is reported at most once per error interval.
+func (h *ServerHook) showError(err error) {
+	// Requests aborted because the hook was stopped are not errors of the server.
+	if h.reqCtx.Err() != nil && errors.Is(err, context.Canceled) {
+		return
+	}
+
+	h.errMu.Lock()
+	defer h.errMu.Unlock()
 
-		h.wg.Done()
+	if !h.suppressErrors && !h.nextError.After(time.Now()) {
+		if h.onError != nil {
+			h.onError(err)
+		} else {
+			ctx := context.WithValue(context.Background(), sendErrorKey{}, true)
+			logrus.WithContext(ctx).Error("Failed to send log to server: " + err.Error())
+		}
+
+		h.nextError = time.Now().Add(h.errorInterval)
+	}
+}
+
+// report passes an error of an entry sent by Fire to the error handler, if one is set.
+// Otherwise, the error is returned to logrus, which prints it.
+func (h *ServerHook) report(err error) error {
+	if err != nil && h.onError != nil {
+		h.showError(err)
+		return nil
 	}
+
+	return err
 }
 
 // serverLogEntry is used to serialize JSON.
 type serverLogEntry struct {
-	Type    string       `json:"type"`
-	Level   logrus.Level `json:"level"`
-	Time    time.Time    `json:"time"`
-	Message string       `json:"message"`
+	Type    string    `json:"type"`
+	Level   string    `json:"level"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+
+	Caller *caller                `json:"caller,omitempty"`
+	Data   map[string]interface{} `json:"data,omitempty"`
 
-	Caller *caller           `json:"caller,omitempty"`
-	Data   map[string]string `json:"data,omitempty"`
+	Host string `json:"host,omitempty"`
+	PID  int    `json:"pid,omitempty"`
 
 	Secret string `json:"secret,omitempty"`
 }
@@ -155,17 +500,168 @@ type logError struct {
 	Err string `json:"error"`
 }
 
-func (h *ServerHook) sendEntry(entry *logrus.Entry) error {
-	e := h.createServerEntry(entry)
+// statusError is returned, if the server responded with an error status code.
+type statusError struct {
+	status     int
+	msg        string
+	retryAfter time.Duration
+	hasRetry   bool // whether the response contained a valid Retry-After header
+}
+
+func (e *statusError) Error() string {
+	if e.msg != "" {
+		return e.msg
+	}
+
+	return fmt.Sprintf("status %d returned", e.status)
+}
+
+// temporary returns whether sending log entries might succeed when retrying after the error.
+func temporary(err error) bool {
+	var serr *statusError
+	if errors.As(err, &serr) {
+		return serr.status == http.StatusTooManyRequests || serr.status >= 500
+	}
+
+	return true
+}
+
+// retryAfter returns the delay requested by the server before sending the next request.
+// The bool is false, if the server did not request to wait.
+func retryAfter(err error) (time.Duration, bool) {
+	var serr *statusError
+	if errors.As(err, &serr) {
+		return serr.retryAfter, serr.hasRetry
+	}
+
+	return 0, false
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a number of seconds or a HTTP date.
+// The bool is false, if the value is invalid.
+func parseRetryAfter(s string) (time.Duration, bool) {
+	var d time.Duration
+
+	if secs, err := strconv.Atoi(s); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(s); err == nil {
+		d = time.Until(t)
+	} else {
+		return 0, false
+	}
+
+	if d < 0 {
+		return 0, true
+	}
+	if d > maxRetryAfter {
+		return maxRetryAfter, true
+	}
+
+	return d, true
+}
+
+// sendMode defines, how failed requests are retried.
+type sendMode int
+
+const (
+	// sendOnce sends the entries with a single attempt.
+	sendOnce sendMode = iota
+
+	// sendCaller retries as configured by WithRetries. Used when sending in the go routine of the caller.
+	sendCaller
+
+	// sendWorker additionally waits for the duration of a Retry-After header and retries as long as the server sends it.
+	// Used by the background workers, so the caller is never blocked by the server.
+	sendWorker
+)
+
+// sendEntry sends a single log entry to the server.
+func (h *ServerHook) sendEntry(entry *logrus.Entry, mode sendMode) error {
+	err := h.send(h.createServerEntry(entry), mode)
+	h.count(1, err)
+
+	return err
+}
+
+// sendBatch sends multiple log entries as a JSON array to the server.
+func (h *ServerHook) sendBatch(entries []*serverLogEntry, mode sendMode) error {
+	err := h.send(entries, mode)
+	h.count(len(entries), err)
+
+	return err
+}
+
+// count updates the delivery statistics after sending n entries.
+func (h *ServerHook) count(n int, err error) {
+	if err == nil {
+		atomic.AddUint64(&h.sent, uint64(n))
+	} else {
+		atomic.AddUint64(&h.failed, uint64(n))
+	}
+}
 
-	jsonData, err := json.Marshal(e)
+// send serializes the value and sends it to the server.
+// Temporary errors are retried with an exponential backoff, which is interrupted when the hook is closed.
+func (h *ServerHook) send(v interface{}, mode sendMode) error {
+	jsonData, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
 
+	backoff := h.retryBackoff
+	retries := 0
+
+	for {
+		err = h.post(jsonData)
+		if err == nil {
+			return nil
+		}
+
+		if mode == sendOnce || !temporary(err) {
+			return err
+		}
+
+		// As long as the server requests to wait, the worker keeps retrying the entries.
+		// These retries do not count towards the configured number of retries.
+		if wait, ok := retryAfter(err); mode == sendWorker && ok {
+			if !h.sleep(wait) {
+				return err
+			}
+
+			continue
+		}
+
+		if retries >= h.retries || !h.sleep(backoff) {
+			return err
+		}
+
+		retries++
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// sleep waits for the duration d. Returns false, if the hook was closed in the meantime.
+func (h *ServerHook) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// post sends the JSON data to the server via a HTTP POST call.
+func (h *ServerHook) post(jsonData []byte) error {
 	r := bytes.NewReader(jsonData)
 
-	req, err := http.NewRequest(http.MethodPost, h.url, r)
+	req, err := http.NewRequestWithContext(h.reqCtx, http.MethodPost, h.url, r)
 	if err != nil {
 		return err
 	}
@@ -173,11 +669,11 @@ func (h *ServerHook) sendEntry(entry *logrus.Entry) error {
 	req.Header.Set("accept", "application/json")
 	req.Header.Set("Content-Type", "application/json")
 
-	client := http.Client{
-		Timeout: time.Second * 10,
+	for k, v := range h.headers {
+		req.Header.Set(k, v)
 	}
 
-	res, err := client.Do(req)
+	res, err := h.client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -195,17 +691,29 @@ func (h *ServerHook) sendEntry(entry *logrus.Entry) error {
 		return err
 	}
 
+	// The error message is optional, so the body may not be valid JSON.
 	var logErr logError
-	err = json.Unmarshal(body, &logErr)
-	if err != nil {
-		return err
+	_ = json.Unmarshal(body, &logErr)
+
+	serr := &statusError{status: res.StatusCode, msg: logErr.Err}
+
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable {
+		serr.retryAfter, serr.hasRetry = parseRetryAfter(res.Header.Get("Retry-After"))
 	}
 
-	if logErr.Err != "" {
-		return errors.New(logErr.Err)
+	return serr
+}
+
+// fieldValue returns the value of a field to be sent to the server.
+// Typed values, that cannot be serialized as JSON, are converted to strings, so the entry can still be sent.
+func (h *ServerHook) fieldValue(v interface{}) interface{} {
+	if h.typedFields {
+		if _, err := json.Marshal(v); err == nil {
+			return v
+		}
 	}
 
-	return fmt.Errorf("status %d returned", res.StatusCode)
+	return fmt.Sprint(v)
 }
 
 // createServerEntry creates a log entry which can be send to the log server from a logrus entry.
@@ -220,24 +728,27 @@ func (h *ServerHook) createServerEntry(entry *logrus.Entry) *serverLogEntry {
 
 	e := &serverLogEntry{
 		Type:    h.typ,
-		Level:   entry.Level,
+		Level:   levelName(entry.Level),
 		Time:    entry.Time,
 		Message: msg,
+		Host:    h.host,
+		PID:     h.pid,
 		Secret:  h.secret,
 	}
 
 	d := entry.Data
 	if len(d) > 0 {
-		f := make(map[string]string, len(d))
+		f := make(map[string]interface{}, len(d))
 		for k, v := range d {
-			var stringval string
-			if s, ok := v.(string); ok {
-				stringval = s
-			} else {
-				stringval = fmt.Sprint(s)
+			switch val := v.(type) {
+			case string:
+				f[k] = val
+			case error:
+				// errors usually have no exported fields, so they would be serialized as an empty object
+				f[k] = fmt.Sprint(val)
+			default:
+				f[k] = h.fieldValue(val)
 			}
-
-			f[k] = stringval
 		}
 
 		e.Data = f
@@ -0,0 +1,637 @@
+package serverhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testServer records the bodies of all requests sent to it.
+type testServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	bodies [][]byte
+}
+
+// newTestServer creates a test server, which calls respond for the n-th request (starting at 1).
+// If respond is nil, every request succeeds.
+func newTestServer(t *testing.T, respond func(w http.ResponseWriter, n int)) *testServer {
+	s := &testServer{}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read body: %v", err)
+		}
+
+		s.mu.Lock()
+		s.bodies = append(s.bodies, body)
+		n := len(s.bodies)
+		s.mu.Unlock()
+
+		if respond != nil {
+			respond(w, n)
+		}
+	}))
+
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// requests returns the bodies of all received requests.
+func (s *testServer) requests() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([][]byte(nil), s.bodies...)
+}
+
+// newTestLogger creates a logger, that only writes to the hook.
+func newTestLogger(h *ServerHook) *logrus.Logger {
+	l := logrus.New()
+	l.SetOutput(ioutil.Discard)
+	l.SetLevel(logrus.TraceLevel)
+	l.AddHook(h)
+
+	return l
+}
+
+func TestFieldValues(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	h, err := NewServerHook("test", s.URL, Synchronous(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	newTestLogger(h).WithFields(logrus.Fields{
+		"int":    42,
+		"bool":   true,
+		"string": "abc",
+	}).Info("message")
+
+	reqs := s.requests()
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(reqs))
+	}
+
+	var e struct {
+		Data map[string]string `json:"data"`
+	}
+
+	err = json.Unmarshal(reqs[0], &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"int":    "42",
+		"bool":   "true",
+		"string": "abc",
+	}
+
+	for k, v := range expected {
+		if e.Data[k] != v {
+			t.Errorf("field %q: expected %q, got %q", k, v, e.Data[k])
+		}
+	}
+}
+
+func TestBatchFlush(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	h, err := NewServerHook("test", s.URL, WithBatch(10, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	l := newTestLogger(h)
+	for i := 0; i < 3; i++ {
+		l.WithField("n", i).Info("message")
+	}
+
+	if n := len(s.requests()); n != 0 {
+		t.Fatalf("expected no request before flushing, got %d", n)
+	}
+
+	h.Flush()
+
+	reqs := s.requests()
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(reqs))
+	}
+
+	var entries []serverLogEntry
+
+	err = json.Unmarshal(reqs[0], &entries)
+	if err != nil {
+		t.Fatalf("batch is not a JSON array: %v", err)
+	}
+
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+
+	for i, e := range entries {
+		if e.Data["n"] != strconv.Itoa(i) {
+			t.Errorf("entry %d: wrong order, got field n=%v", i, e.Data["n"])
+		}
+	}
+}
+
+func TestBatchClose(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	h, err := NewServerHook("test", s.URL, WithBatch(10, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := newTestLogger(h)
+	l.Info("first")
+	l.Info("second")
+
+	h.Close()
+
+	reqs := s.requests()
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(reqs))
+	}
+
+	var entries []serverLogEntry
+
+	err = json.Unmarshal(reqs[0], &entries)
+	if err != nil {
+		t.Fatalf("batch is not a JSON array: %v", err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+}
+
+func TestBatchDefaultInterval(t *testing.T) {
+	for _, size := range []int{0, 1, 10} {
+		h, err := NewServerHook("test", "http://localhost", WithBatch(size, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !h.batch {
+			t.Errorf("size %d: batching is disabled", size)
+		}
+
+		if h.batchInterval != defaultBatchInterval {
+			t.Errorf("size %d: expected batch interval %v, got %v", size, defaultBatchInterval, h.batchInterval)
+		}
+
+		h.Close()
+	}
+}
+
+func TestRetries(t *testing.T) {
+	const retries = 3
+
+	s := newTestServer(t, func(w http.ResponseWriter, n int) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	h, err := NewServerHook("test", s.URL, WithRetries(retries, time.Millisecond), SuppressErrors(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newTestLogger(h).Info("message")
+	h.Close()
+
+	if n := len(s.requests()); n != retries+1 {
+		t.Errorf("expected %d requests, got %d", retries+1, n)
+	}
+
+	if st := h.Stats(); st.Failed != 1 || st.Sent != 0 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	s := newTestServer(t, func(w http.ResponseWriter, n int) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+
+	h, err := NewServerHook("test", s.URL, WithRetries(3, time.Millisecond), SuppressErrors(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newTestLogger(h).Info("message")
+	h.Close()
+
+	if n := len(s.requests()); n != 1 {
+		t.Errorf("expected 1 request, got %d", n)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	s := newTestServer(t, retryAfterOnce("1"))
+
+	h, err := NewServerHook("test", s.URL, SuppressErrors(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+
+	newTestLogger(h).Info("message")
+	h.Close()
+
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("expected the worker to wait for Retry-After, returned after %v", d)
+	}
+
+	if st := h.Stats(); st.Sent != 1 {
+		t.Errorf("expected the entry to be retried, got stats %+v", st)
+	}
+}
+
+func TestRetryAfterSynchronous(t *testing.T) {
+	s := newTestServer(t, retryAfterOnce("3"))
+
+	h, err := NewServerHook("test", s.URL, Synchronous(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	start := time.Now()
+
+	newTestLogger(h).Info("message")
+
+	if d := time.Since(start); d >= time.Second {
+		t.Errorf("synchronous logging blocked for %v", d)
+	}
+
+	if n := len(s.requests()); n != 1 {
+		t.Errorf("expected 1 request, got %d", n)
+	}
+}
+
+func TestRetryAfterRepeated(t *testing.T) {
+	s := newTestServer(t, func(w http.ResponseWriter, n int) {
+		if n <= 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	})
+
+	h, err := NewServerHook("test", s.URL, SuppressErrors(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newTestLogger(h).Info("message")
+	h.Close()
+
+	if st := h.Stats(); st.Sent != 1 {
+		t.Errorf("expected the entry to be sent after repeated Retry-After responses, got stats %+v", st)
+	}
+}
+
+// retryAfterOnce responds to the first request with 429 and a Retry-After header and accepts all further requests.
+func retryAfterOnce(retryAfter string) func(w http.ResponseWriter, n int) {
+	return func(w http.ResponseWriter, n int) {
+		if n == 1 {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}
+}
+
+func TestLevelName(t *testing.T) {
+	tests := []struct {
+		level    logrus.Level
+		expected string
+	}{
+		{logrus.PanicLevel, "fatal"},
+		{logrus.FatalLevel, "fatal"},
+		{logrus.ErrorLevel, "error"},
+		{logrus.WarnLevel, "warn"},
+		{logrus.InfoLevel, "info"},
+		{logrus.DebugLevel, "debug"},
+		{logrus.TraceLevel, "trace"},
+	}
+
+	for _, test := range tests {
+		if name := levelName(test.level); name != test.expected {
+			t.Errorf("level %v: expected %q, got %q", test.level, test.expected, name)
+		}
+	}
+}
+
+func TestLevelJSON(t *testing.T) {
+	h, err := NewServerHook("test", "http://localhost", Synchronous(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	entry := logrus.NewEntry(logrus.New())
+	entry.Level = logrus.WarnLevel
+
+	data, err := json.Marshal(h.createServerEntry(entry))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var e struct {
+		Level string `json:"level"`
+	}
+
+	err = json.Unmarshal(data, &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Level != "warn" {
+		t.Errorf("expected level \"warn\", got %q", e.Level)
+	}
+}
+
+type testError struct {
+	msg string
+}
+
+func (e *testError) Error() string {
+	return e.msg // panics for a nil error
+}
+
+func TestNilErrorField(t *testing.T) {
+	for _, typed := range []bool{false, true} {
+		h, err := NewServerHook("test", "http://localhost", Synchronous(true), WithTypedFields(typed))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entry := logrus.NewEntry(logrus.New()).WithField("err", (*testError)(nil))
+
+		e := h.createServerEntry(entry)
+		if e.Data["err"] != "<nil>" {
+			t.Errorf("typed %v: expected \"<nil>\", got %v", typed, e.Data["err"])
+		}
+
+		h.Close()
+	}
+}
+
+func TestTypedFields(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	h, err := NewServerHook("test", s.URL, WithTypedFields(true), WithBatch(10, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := newTestLogger(h)
+	l.WithField("int", 42).WithField("bool", true).Info("typed")
+	l.WithField("nan", math.NaN()).Info("invalid")
+
+	h.Close()
+
+	reqs := s.requests()
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(reqs))
+	}
+
+	var entries []serverLogEntry
+
+	err = json.Unmarshal(reqs[0], &entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+
+	if v, ok := entries[0].Data["int"].(float64); !ok || v != 42 {
+		t.Errorf("expected number 42, got %#v", entries[0].Data["int"])
+	}
+	if v, ok := entries[0].Data["bool"].(bool); !ok || !v {
+		t.Errorf("expected true, got %#v", entries[0].Data["bool"])
+	}
+	if entries[1].Data["nan"] != "NaN" {
+		t.Errorf("expected \"NaN\", got %#v", entries[1].Data["nan"])
+	}
+}
+
+func TestPanicSentOnce(t *testing.T) {
+	s := newTestServer(t, func(w http.ResponseWriter, n int) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	h, err := NewServerHook("test", s.URL, WithRetries(5, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	entry := logrus.NewEntry(logrus.New())
+	entry.Level = logrus.PanicLevel
+
+	start := time.Now()
+
+	if err := h.Fire(entry); err == nil {
+		t.Error("expected an error")
+	}
+
+	if d := time.Since(start); d >= time.Second {
+		t.Errorf("panic entry was retried, took %v", d)
+	}
+
+	if n := len(s.requests()); n != 1 {
+		t.Errorf("expected 1 request, got %d", n)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	s := newTestServer(t, func(w http.ResponseWriter, n int) {
+		time.Sleep(2 * time.Second)
+	})
+
+	for _, batch := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		opts := []Option{WithDrainTimeout(100 * time.Millisecond), WithRetries(5, time.Second), SuppressErrors(true)}
+		if batch {
+			opts = append(opts, WithBatch(2, time.Hour))
+		}
+
+		h, err := NewServerHookContext(ctx, "test", s.URL, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l := newTestLogger(h)
+		for i := 0; i < 10; i++ {
+			l.Info("message")
+		}
+
+		start := time.Now()
+		cancel()
+
+		for h.Stats().Buffered > 0 {
+			if time.Since(start) > time.Second {
+				t.Fatalf("batch %v: shutdown not bounded by the drain timeout, stats: %+v", batch, h.Stats())
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if st := h.Stats(); st.Sent != 0 || st.Failed != 10 {
+			t.Errorf("batch %v: expected all entries to be dropped, got %+v", batch, st)
+		}
+
+		if err := h.Fire(logrus.NewEntry(l)); err == nil {
+			t.Errorf("batch %v: expected an error after the context was cancelled", batch)
+		}
+	}
+}
+
+func TestCloseStandardLogger(t *testing.T) {
+	s := newTestServer(t, func(w http.ResponseWriter, n int) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	h, err := NewServerHook("test", s.URL, WithErrorInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Send errors are logged to the standard logger, which also fires the hook.
+	std := logrus.StandardLogger()
+	std.SetOutput(ioutil.Discard)
+	std.AddHook(h)
+
+	defer func() {
+		std.ReplaceHooks(make(logrus.LevelHooks))
+		std.SetOutput(os.Stderr)
+	}()
+
+	for i := 0; i < 10; i++ {
+		logrus.Info("message")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.Flush()
+		logrus.Info("message")
+		h.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Flush or Close did not return")
+	}
+
+	if n := len(s.requests()); n != 11 {
+		t.Errorf("expected 11 requests, got %d", n)
+	}
+}
+
+func TestOnErrorSynchronous(t *testing.T) {
+	s := newTestServer(t, func(w http.ResponseWriter, n int) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	var errs int
+
+	h, err := NewServerHook("test", s.URL, Synchronous(true), WithErrorInterval(0), OnError(func(error) {
+		errs++
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	entry := logrus.NewEntry(logrus.New())
+	entry.Level = logrus.InfoLevel
+
+	if err := h.Fire(entry); err != nil {
+		t.Errorf("expected the error to be passed to the handler, got %v", err)
+	}
+
+	entry.Level = logrus.FatalLevel
+
+	if err := h.Fire(entry); err != nil {
+		t.Errorf("expected the error to be passed to the handler, got %v", err)
+	}
+
+	if errs != 2 {
+		t.Errorf("expected 2 errors, got %d", errs)
+	}
+}
+
+func TestDrainDoesNotBlock(t *testing.T) {
+	s := newTestServer(t, func(w http.ResponseWriter, n int) {
+		time.Sleep(2 * time.Second)
+	})
+
+	var errs int32
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	h, err := NewServerHookContext(ctx, "test", s.URL, WithDrainTimeout(500*time.Millisecond), WithErrorInterval(0), OnError(func(error) {
+		atomic.AddInt32(&errs, 1)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := newTestLogger(h)
+	for i := 0; i < 5; i++ {
+		l.Info("message")
+	}
+
+	cancel()
+
+	// Wait until the hook is closing, then log in another go routine while the queue is drained.
+	for h.Fire(logrus.NewEntry(l)) == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		l.Info("message")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("logging blocked while the queue was drained")
+	}
+
+	for h.Stats().Buffered > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&errs); n != 0 {
+		t.Errorf("expected aborted requests not to be reported, got %d errors", n)
+	}
+}
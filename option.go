@@ -1,5 +1,10 @@
 package serverhook
 
+import (
+	"net/http"
+	"time"
+)
+
 // Option is the parameter type for options when initializing the log hook.
 type Option interface {
 	apply(h *ServerHook)
@@ -48,3 +53,152 @@ type synchronousOption bool
 func (o synchronousOption) apply(h *ServerHook) {
 	h.synchronous = bool(o)
 }
+
+// IncludeMeta - include the hostname and the process id in log entries.
+func IncludeMeta(val bool) Option {
+	return includeMetaOption(val)
+}
+
+type includeMetaOption bool
+
+func (o includeMetaOption) apply(h *ServerHook) {
+	h.includeMeta = bool(o)
+}
+
+// WithBufferSize - size of the buffer for log entries that are sent asynchronously.
+// Defaults to BufSize.
+func WithBufferSize(size uint) Option {
+	return bufferSizeOption(size)
+}
+
+type bufferSizeOption uint
+
+func (o bufferSizeOption) apply(h *ServerHook) {
+	h.bufSize = uint(o)
+}
+
+// WithBatch - send log entries in batches as a JSON array.
+// A batch is sent once it contains size entries or when the interval elapsed.
+// A size <= 0 limits batches only by the interval. If the interval is <= 0, it defaults to 5 seconds.
+// Has no effect on synchronous hooks.
+func WithBatch(size int, interval time.Duration) Option {
+	return batchOption{size: size, interval: interval}
+}
+
+type batchOption struct {
+	size     int
+	interval time.Duration
+}
+
+func (o batchOption) apply(h *ServerHook) {
+	h.batch = true
+	h.batchSize = o.size
+	h.batchInterval = o.interval
+}
+
+// WithRetries - retry sending log entries up to n times on network errors and 429 or 5xx responses.
+// The backoff between two attempts doubles after each retry.
+func WithRetries(n int, backoff time.Duration) Option {
+	return retryOption{n: n, backoff: backoff}
+}
+
+type retryOption struct {
+	n       int
+	backoff time.Duration
+}
+
+func (o retryOption) apply(h *ServerHook) {
+	h.retries = o.n
+	h.retryBackoff = o.backoff
+}
+
+// WithHTTPClient - HTTP client used to send log entries to the server.
+// By default, a client with a timeout of 10 seconds is used.
+func WithHTTPClient(c *http.Client) Option {
+	return httpClientOption{c}
+}
+
+type httpClientOption struct {
+	c *http.Client
+}
+
+func (o httpClientOption) apply(h *ServerHook) {
+	h.client = o.c
+}
+
+// WithTimeout - timeout of requests to the server. Also applies to a client passed by WithHTTPClient.
+func WithTimeout(d time.Duration) Option {
+	return timeoutOption(d)
+}
+
+type timeoutOption time.Duration
+
+func (o timeoutOption) apply(h *ServerHook) {
+	h.timeout = time.Duration(o)
+}
+
+// WithHeaders - additional headers sent with every request. May override the built-in headers.
+func WithHeaders(headers map[string]string) Option {
+	return headersOption(headers)
+}
+
+type headersOption map[string]string
+
+func (o headersOption) apply(h *ServerHook) {
+	if h.headers == nil {
+		h.headers = make(map[string]string, len(o))
+	}
+
+	for k, v := range o {
+		h.headers[k] = v
+	}
+}
+
+// WithErrorInterval - minimum interval between two printed send errors. Defaults to 10 minutes.
+// An interval of 0 prints every error.
+func WithErrorInterval(d time.Duration) Option {
+	return errorIntervalOption(d)
+}
+
+type errorIntervalOption time.Duration
+
+func (o errorIntervalOption) apply(h *ServerHook) {
+	h.errorInterval = time.Duration(o)
+}
+
+// OnError - function called when sending log entries failed, instead of printing the error.
+// Applies to asynchronous and synchronous sends; Fire then does not return send errors to logrus.
+// Errors are still limited by the error interval and SuppressErrors.
+func OnError(fn func(error)) Option {
+	return onErrorOption(fn)
+}
+
+type onErrorOption func(error)
+
+func (o onErrorOption) apply(h *ServerHook) {
+	h.onError = o
+}
+
+// WithTypedFields - send field values with their JSON types instead of converting them to strings.
+// Errors are always sent as strings.
+func WithTypedFields(val bool) Option {
+	return typedFieldsOption(val)
+}
+
+type typedFieldsOption bool
+
+func (o typedFieldsOption) apply(h *ServerHook) {
+	h.typedFields = bool(o)
+}
+
+// WithDrainTimeout - time to send the remaining entries when the context passed to NewServerHookContext is cancelled.
+// Defaults to 10 seconds. A timeout <= 0 waits until all entries are sent.
+func WithDrainTimeout(d time.Duration) Option {
+	return drainTimeoutOption(d)
+}
+
+type drainTimeoutOption time.Duration
+
+func (o drainTimeoutOption) apply(h *ServerHook) {
+	h.drainTimeout = time.Duration(o)
+}
@@ -3,6 +3,8 @@ package serverhook
 import (
 	"regexp"
 	"strings"
+
+	"github.com/sirupsen/logrus"
 )
 
 var colorParts = []string{
@@ -13,9 +15,33 @@ var colorRegex = regexp.MustCompile(strings.Join(colorParts, "|"))
 
 // removeColors removes ANSI-colors in a string
 func removeColors(s string) string {
+	// Skip the regex if the string does not contain any escape characters.
+	if !strings.ContainsAny(s, "\u001B\u009B") {
+		return s
+	}
+
 	if colorRegex.MatchString(s) {
 		return colorRegex.ReplaceAllString(s, "")
 	}
 
 	return s
 }
+
+// levelName returns the name of a logrus level as expected by the log server.
+// The log server does not know the panic level, so it is sent as fatal.
+func levelName(l logrus.Level) string {
+	switch l {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return "fatal"
+	case logrus.ErrorLevel:
+		return "error"
+	case logrus.WarnLevel:
+		return "warn"
+	case logrus.InfoLevel:
+		return "info"
+	case logrus.DebugLevel:
+		return "debug"
+	default:
+		return "trace"
+	}
+}